@@ -21,6 +21,7 @@ package testutils
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 
 	"google.golang.org/grpc/balancer"
@@ -44,21 +45,73 @@ var TestSubConns []*TestSubConn
 func init() {
 	for i := 0; i < TestSubConnsCount; i++ {
 		TestSubConns = append(TestSubConns, &TestSubConn{
-			id: fmt.Sprintf("sc%d", i),
+			id:                fmt.Sprintf("sc%d", i),
+			ConnectCh:         make(chan balancer.SubConn, 10),
+			UpdateAddressesCh: make(chan UpdateAddressesCall, 10),
+			StateListener:     make(chan balancer.SubConnState, 10),
 		})
 	}
 }
 
+// UpdateAddressesCall records a TestSubConn.UpdateAddresses call.
+type UpdateAddressesCall struct {
+	SC    balancer.SubConn
+	Addrs []resolver.Address
+}
+
 // TestSubConn implements the SubConn interface, to be used in tests.
 type TestSubConn struct {
 	id string
+
+	// PanicOnUnimplemented, when set, panics on Connect/UpdateAddresses
+	// instead of recording them, to catch unexpected calls.
+	PanicOnUnimplemented bool
+
+	ConnectCh         chan balancer.SubConn
+	UpdateAddressesCh chan UpdateAddressesCall
+
+	// StateListener records every state reported for this SubConn via
+	// TestClientConn.SetSubConnState.
+	StateListener chan balancer.SubConnState
+}
+
+// UpdateAddresses records addrs on UpdateAddressesCh.
+func (tsc *TestSubConn) UpdateAddresses(addrs []resolver.Address) {
+	if tsc.PanicOnUnimplemented {
+		panic("not implemented")
+	}
+	select {
+	case tsc.UpdateAddressesCh <- UpdateAddressesCall{SC: tsc, Addrs: addrs}:
+	default:
+	}
 }
 
-// UpdateAddresses panics.
-func (tsc *TestSubConn) UpdateAddresses([]resolver.Address) { panic("not implemented") }
+// Connect records that Connect was called on ConnectCh.
+func (tsc *TestSubConn) Connect() {
+	if tsc.PanicOnUnimplemented {
+		panic("not implemented")
+	}
+	select {
+	case tsc.ConnectCh <- tsc:
+	default:
+	}
+}
 
-// Connect is a no-op.
-func (tsc *TestSubConn) Connect() {}
+// reset clears PanicOnUnimplemented and drains tsc's channels, so handing it
+// out again from the shared TestSubConns pool (see TestClientConn.NewSubConn)
+// doesn't leak state from a prior test.
+func (tsc *TestSubConn) reset() {
+	tsc.PanicOnUnimplemented = false
+	for len(tsc.ConnectCh) > 0 {
+		<-tsc.ConnectCh
+	}
+	for len(tsc.UpdateAddressesCh) > 0 {
+		<-tsc.UpdateAddressesCh
+	}
+	for len(tsc.StateListener) > 0 {
+		<-tsc.StateListener
+	}
+}
 
 // String implements stringer to print human friendly error message.
 func (tsc *TestSubConn) String() string {
@@ -76,6 +129,51 @@ type TestClientConn struct {
 	NewPickerCh chan balancer.Picker    // the last picker updated.
 	NewStateCh  chan connectivity.State // the last state.
 
+	ResolveNowCh chan resolver.ResolveNowOptions // up to 10 unread resolve now options; later ones are dropped while it is full.
+
+	// PanicOnUnimplemented, when set, panics on ResolveNow/Target instead of
+	// recording/returning a value.
+	PanicOnUnimplemented bool
+
+	// TargetStr is returned by Target.
+	TargetStr string
+
+	// bal is the balancer under test, set by NewTestClientConnWithBalancer.
+	// SetSubConnState routes through it, if set.
+	bal balancer.Balancer
+
+	// mu protects the fields below other than subConnIdx;
+	// NewSubConn/RemoveSubConn/UpdateState can mutate them from the balancer's
+	// own goroutine.
+	mu sync.Mutex
+
+	// createdSubConns is every SubConn ever created, in creation order.
+	createdSubConns []balancer.SubConn
+
+	// removedSubConns records every SubConn ever passed to RemoveSubConn.
+	removedSubConns map[balancer.SubConn]bool
+
+	// subConnAddrs records the addresses each SubConn was created with;
+	// liveAddrs is the address set from the most recent
+	// UpdateClientConnState step. Together they let OrphanedSubConns tell
+	// when a SubConn's address has been dropped.
+	subConnAddrs map[balancer.SubConn][]resolver.Address
+	liveAddrs    map[string]bool
+
+	// lastState and lastPicker cache the most recent values passed to
+	// UpdateState.
+	lastState  connectivity.State
+	lastPicker balancer.Picker
+
+	// closed indicates the balancer under test has been closed; set by
+	// SetClosed, since balancer.Balancer.Close is a one-way call the
+	// ClientConn doesn't otherwise observe.
+	closed bool
+
+	// pickerUpdatedAfterClose records whether UpdateState was called after
+	// SetClosed.
+	pickerUpdatedAfterClose bool
+
 	subConnIdx int
 }
 
@@ -90,14 +188,133 @@ func NewTestClientConn(t *testing.T) *TestClientConn {
 
 		NewPickerCh: make(chan balancer.Picker, 1),
 		NewStateCh:  make(chan connectivity.State, 1),
+
+		ResolveNowCh: make(chan resolver.ResolveNowOptions, 10),
+
+		removedSubConns: make(map[balancer.SubConn]bool),
+	}
+}
+
+// CreatedSubConns returns every SubConn created so far, in creation order.
+func (tcc *TestClientConn) CreatedSubConns() []balancer.SubConn {
+	tcc.mu.Lock()
+	defer tcc.mu.Unlock()
+	return append([]balancer.SubConn(nil), tcc.createdSubConns...)
+}
+
+// SubConnRemoved reports whether sc has been passed to RemoveSubConn.
+func (tcc *TestClientConn) SubConnRemoved(sc balancer.SubConn) bool {
+	tcc.mu.Lock()
+	defer tcc.mu.Unlock()
+	return tcc.removedSubConns[sc]
+}
+
+// trackAddresses remembers addrs as the most recent UpdateClientConnState
+// address list, for OrphanedSubConns.
+func (tcc *TestClientConn) trackAddresses(addrs []resolver.Address) {
+	tcc.mu.Lock()
+	defer tcc.mu.Unlock()
+	live := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		live[a.Addr] = true
 	}
+	tcc.liveAddrs = live
+}
+
+// OrphanedSubConns returns every created, non-removed SubConn whose
+// addresses are absent from the most recent UpdateClientConnState step (see
+// trackAddresses). It returns nil until that step has run.
+func (tcc *TestClientConn) OrphanedSubConns() []balancer.SubConn {
+	tcc.mu.Lock()
+	defer tcc.mu.Unlock()
+	if tcc.liveAddrs == nil {
+		return nil
+	}
+	var orphaned []balancer.SubConn
+	for _, sc := range tcc.createdSubConns {
+		if tcc.removedSubConns[sc] {
+			continue
+		}
+		live := false
+		for _, a := range tcc.subConnAddrs[sc] {
+			if tcc.liveAddrs[a.Addr] {
+				live = true
+				break
+			}
+		}
+		if !live {
+			orphaned = append(orphaned, sc)
+		}
+	}
+	return orphaned
+}
+
+// SetClosed marks the balancer under test as closed.
+func (tcc *TestClientConn) SetClosed() {
+	tcc.mu.Lock()
+	defer tcc.mu.Unlock()
+	tcc.closed = true
+}
+
+// IsClosed reports whether SetClosed has been called.
+func (tcc *TestClientConn) IsClosed() bool {
+	tcc.mu.Lock()
+	defer tcc.mu.Unlock()
+	return tcc.closed
+}
+
+// LastState returns the connectivity state and picker most recently passed
+// to UpdateState.
+func (tcc *TestClientConn) LastState() (connectivity.State, balancer.Picker) {
+	tcc.mu.Lock()
+	defer tcc.mu.Unlock()
+	return tcc.lastState, tcc.lastPicker
+}
+
+// PickerUpdatedAfterClose reports whether UpdateState was called after
+// SetClosed.
+func (tcc *TestClientConn) PickerUpdatedAfterClose() bool {
+	tcc.mu.Lock()
+	defer tcc.mu.Unlock()
+	return tcc.pickerUpdatedAfterClose
+}
+
+// NewTestClientConnWithBalancer creates a TestClientConn wired up to drive bal.
+func NewTestClientConnWithBalancer(t *testing.T, bal balancer.Balancer) *TestClientConn {
+	tcc := NewTestClientConn(t)
+	tcc.bal = bal
+	return tcc
+}
+
+// SetSubConnState drives sc through state via the balancer installed by
+// NewTestClientConnWithBalancer.
+func (tcc *TestClientConn) SetSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+	if tsc, ok := sc.(*TestSubConn); ok {
+		select {
+		case tsc.StateListener <- state:
+		default:
+		}
+	}
+	if tcc.bal == nil {
+		panic("testutils: SetSubConnState called on a TestClientConn with no balancer installed; use NewTestClientConnWithBalancer")
+	}
+	tcc.bal.UpdateSubConnState(sc, state)
 }
 
 // NewSubConn creates a new SubConn.
 func (tcc *TestClientConn) NewSubConn(a []resolver.Address, o balancer.NewSubConnOptions) (balancer.SubConn, error) {
 	sc := TestSubConns[tcc.subConnIdx]
+	sc.reset()
 	tcc.subConnIdx++
 
+	tcc.mu.Lock()
+	tcc.createdSubConns = append(tcc.createdSubConns, sc)
+	if tcc.subConnAddrs == nil {
+		tcc.subConnAddrs = make(map[balancer.SubConn][]resolver.Address)
+	}
+	tcc.subConnAddrs[sc] = a
+	tcc.mu.Unlock()
+
 	tcc.logger.Logf("testClientConn: NewSubConn(%v, %+v) => %s", a, o, sc)
 	select {
 	case tcc.NewSubConnAddrsCh <- a:
@@ -115,6 +332,9 @@ func (tcc *TestClientConn) NewSubConn(a []resolver.Address, o balancer.NewSubCon
 // RemoveSubConn removes the SubConn.
 func (tcc *TestClientConn) RemoveSubConn(sc balancer.SubConn) {
 	tcc.logger.Logf("testClientCOnn: RemoveSubConn(%p)", sc)
+	tcc.mu.Lock()
+	tcc.removedSubConns[sc] = true
+	tcc.mu.Unlock()
 	select {
 	case tcc.RemoveSubConnCh <- sc:
 	default:
@@ -130,6 +350,15 @@ func (tcc *TestClientConn) UpdateBalancerState(s connectivity.State, p balancer.
 // UpdateState updates connectivity state and picker.
 func (tcc *TestClientConn) UpdateState(bs balancer.State) {
 	tcc.logger.Logf("testClientConn: UpdateState(%v)", bs)
+
+	tcc.mu.Lock()
+	tcc.lastState = bs.ConnectivityState
+	tcc.lastPicker = bs.Picker
+	if tcc.closed {
+		tcc.pickerUpdatedAfterClose = true
+	}
+	tcc.mu.Unlock()
+
 	select {
 	case <-tcc.NewStateCh:
 	default:
@@ -143,14 +372,23 @@ func (tcc *TestClientConn) UpdateState(bs balancer.State) {
 	tcc.NewPickerCh <- bs.Picker
 }
 
-// ResolveNow panics.
-func (tcc *TestClientConn) ResolveNow(resolver.ResolveNowOptions) {
-	panic("not implemented")
+// ResolveNow records o on ResolveNowCh.
+func (tcc *TestClientConn) ResolveNow(o resolver.ResolveNowOptions) {
+	if tcc.PanicOnUnimplemented {
+		panic("not implemented")
+	}
+	select {
+	case tcc.ResolveNowCh <- o:
+	default:
+	}
 }
 
-// Target panics.
+// Target returns TargetStr.
 func (tcc *TestClientConn) Target() string {
-	panic("not implemented")
+	if tcc.PanicOnUnimplemented {
+		panic("not implemented")
+	}
+	return tcc.TargetStr
 }
 
 // IsRoundRobin checks whether f's return value is roundrobin of elements from
@@ -268,12 +506,65 @@ func (*testConstBalancer) Close() {
 type TestConstPicker struct {
 	Err error
 	SC  balancer.SubConn
+
+	// DoneFn, if set, is used as the Done callback on every PickResult
+	// returned without an error; it is not set when Err is returned.
+	DoneFn func(balancer.DoneInfo)
+
+	// PickCh, if set, records the PickInfo passed to every Pick call.
+	PickCh chan balancer.PickInfo
 }
 
 // Pick returns the const SubConn or the error.
 func (tcp *TestConstPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	if tcp.PickCh != nil {
+		select {
+		case tcp.PickCh <- info:
+		default:
+		}
+	}
 	if tcp.Err != nil {
 		return balancer.PickResult{}, tcp.Err
 	}
-	return balancer.PickResult{SubConn: tcp.SC}, nil
+	return balancer.PickResult{SubConn: tcp.SC, Done: tcp.DoneFn}, nil
+}
+
+// RecordingPicker wraps a picker, recording every pick on PickCh and its
+// Done callback on DoneCh.
+type RecordingPicker struct {
+	Picker balancer.Picker
+
+	PickCh chan balancer.PickInfo
+	DoneCh chan balancer.DoneInfo
+}
+
+// NewRecordingPicker creates a RecordingPicker wrapping p.
+func NewRecordingPicker(p balancer.Picker) *RecordingPicker {
+	return &RecordingPicker{
+		Picker: p,
+		PickCh: make(chan balancer.PickInfo, 10),
+		DoneCh: make(chan balancer.DoneInfo, 10),
+	}
+}
+
+// Pick forwards to the wrapped picker, recording info on PickCh and, if a
+// Done callback is returned, wrapping it to also record on DoneCh.
+func (rp *RecordingPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	select {
+	case rp.PickCh <- info:
+	default:
+	}
+
+	res, err := rp.Picker.Pick(info)
+	if res.Done != nil {
+		done := res.Done
+		res.Done = func(di balancer.DoneInfo) {
+			select {
+			case rp.DoneCh <- di:
+			default:
+			}
+			done(di)
+		}
+	}
+	return res, err
 }
@@ -0,0 +1,190 @@
+/*
+ *
+ * Copyright 2021 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package testutils
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+)
+
+// conformanceSettleTimeout bounds how long invariant checks wait for a
+// balancer's internal goroutine to act on a step.
+const conformanceSettleTimeout = 5 * time.Second
+
+// waitUntil polls cond until it returns true or timeout elapses.
+func waitUntil(timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// allSubConnsRemoved reports whether every SubConn cc has created has also
+// been removed.
+func allSubConnsRemoved(cc *TestClientConn) bool {
+	for _, sc := range cc.CreatedSubConns() {
+		if !cc.SubConnRemoved(sc) {
+			return false
+		}
+	}
+	return true
+}
+
+// ConformanceStep is one scripted action applied to the balancer under test
+// by ConformanceSuite.
+type ConformanceStep func(t *testing.T, bal balancer.Balancer, cc *TestClientConn)
+
+// ScenarioBuilder builds a scripted sequence of ConformanceSteps for
+// ConformanceSuite to run.
+type ScenarioBuilder struct {
+	steps []ConformanceStep
+}
+
+// NewScenarioBuilder returns an empty ScenarioBuilder.
+func NewScenarioBuilder() *ScenarioBuilder {
+	return &ScenarioBuilder{}
+}
+
+// UpdateClientConnState appends a step that calls UpdateClientConnState on
+// the balancer under test with s.
+func (b *ScenarioBuilder) UpdateClientConnState(s balancer.ClientConnState) *ScenarioBuilder {
+	return b.Append(func(t *testing.T, bal balancer.Balancer, cc *TestClientConn) {
+		if err := bal.UpdateClientConnState(s); err != nil {
+			t.Fatalf("UpdateClientConnState(%+v) returned error: %v", s, err)
+		}
+		cc.trackAddresses(s.ResolverState.Addresses)
+	})
+}
+
+// UpdateSubConnState appends a step that transitions the SubConn created at
+// subConnIndex (0-based, in creation order) to state.
+func (b *ScenarioBuilder) UpdateSubConnState(subConnIndex int, state balancer.SubConnState) *ScenarioBuilder {
+	return b.Append(func(t *testing.T, bal balancer.Balancer, cc *TestClientConn) {
+		scs := cc.CreatedSubConns()
+		if subConnIndex >= len(scs) {
+			t.Fatalf("scenario step references SubConn %d, but only %d have been created", subConnIndex, len(scs))
+		}
+		cc.SetSubConnState(scs[subConnIndex], state)
+	})
+}
+
+// ResolverError appends a step that calls ResolverError on the balancer
+// under test with err.
+func (b *ScenarioBuilder) ResolverError(err error) *ScenarioBuilder {
+	return b.Append(func(t *testing.T, bal balancer.Balancer, cc *TestClientConn) {
+		bal.ResolverError(err)
+	})
+}
+
+// Close appends a step that closes the balancer under test.
+func (b *ScenarioBuilder) Close() *ScenarioBuilder {
+	return b.Append(func(t *testing.T, bal balancer.Balancer, cc *TestClientConn) {
+		bal.Close()
+		cc.SetClosed()
+	})
+}
+
+// Append adds a balancer-specific step to the scenario.
+func (b *ScenarioBuilder) Append(step ConformanceStep) *ScenarioBuilder {
+	b.steps = append(b.steps, step)
+	return b
+}
+
+// Build returns the scripted steps accumulated so far.
+func (b *ScenarioBuilder) Build() []ConformanceStep {
+	return b.steps
+}
+
+// ConformanceSuite builds a balancer from builder, drives it through
+// scenario, and after every step asserts invariants every balancer.Balancer
+// must obey:
+//   - connectivity.Ready is never reported with a nil picker
+//   - Close removes every SubConn it created and stops updating the picker
+//   - a SubConn is removed as soon as its address is dropped, not deferred
+//     until Close
+//
+// Balancer-specific assertions belong in steps appended via Append.
+func ConformanceSuite(t *testing.T, builder balancer.Builder, scenario []ConformanceStep) {
+	t.Helper()
+
+	cc := NewTestClientConn(t)
+	bal := builder.Build(cc, balancer.BuildOptions{})
+	if bal == nil {
+		t.Fatalf("%s balancer builder returned a nil balancer", builder.Name())
+	}
+	cc.bal = bal
+
+	for _, step := range scenario {
+		step(t, bal, cc)
+		assertConformanceInvariants(t, cc)
+	}
+
+	if !cc.IsClosed() {
+		bal.Close()
+		cc.SetClosed()
+	}
+	assertAllSubConnsRemoved(t, cc)
+}
+
+// assertConformanceInvariants checks the invariants that must hold after a
+// scenario step, waiting up to conformanceSettleTimeout for the balancer's
+// internal goroutine to settle first. It reads state/picker off
+// TestClientConn.LastState rather than NewStateCh/NewPickerCh, which
+// balancer-specific steps may also be draining.
+func assertConformanceInvariants(t *testing.T, cc *TestClientConn) {
+	t.Helper()
+
+	waitUntil(conformanceSettleTimeout, func() bool {
+		state, picker := cc.LastState()
+		return state != connectivity.Ready || picker != nil
+	})
+	if state, picker := cc.LastState(); state == connectivity.Ready && picker == nil {
+		t.Fatalf("balancer reported READY with a nil picker")
+	}
+
+	if cc.IsClosed() {
+		waitUntil(conformanceSettleTimeout, func() bool { return allSubConnsRemoved(cc) })
+		if cc.PickerUpdatedAfterClose() {
+			t.Fatalf("balancer updated picker after Close")
+		}
+		return
+	}
+
+	waitUntil(conformanceSettleTimeout, func() bool { return len(cc.OrphanedSubConns()) == 0 })
+	if orphaned := cc.OrphanedSubConns(); len(orphaned) > 0 {
+		t.Fatalf("SubConn(s) %v still present after their addresses were dropped from a ClientConnState update; RemoveSubConn must be called when an address is orphaned, not deferred to Close", orphaned)
+	}
+}
+
+// assertAllSubConnsRemoved checks that every SubConn the balancer ever
+// created has since been removed, waiting up to conformanceSettleTimeout for
+// the balancer's Close processing to finish first.
+func assertAllSubConnsRemoved(t *testing.T, cc *TestClientConn) {
+	t.Helper()
+
+	waitUntil(conformanceSettleTimeout, func() bool { return allSubConnsRemoved(cc) })
+	for _, sc := range cc.CreatedSubConns() {
+		if !cc.SubConnRemoved(sc) {
+			t.Errorf("SubConn %v was never removed", sc)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ *
+ * Copyright 2021 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package testutils
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/grpc/balancer"
+)
+
+// chiSquarePValue is the significance level used by IsWeightedRoundRobin to
+// decide whether an observed distribution of picks is consistent with the
+// wanted weights. It is intentionally small to keep the test flake rate low,
+// at the cost of being less sensitive to small deviations.
+const chiSquarePValue = 0.001
+
+// zScoreForChiSquarePValue is the standard normal quantile for
+// 1-chiSquarePValue, used by the Wilson-Hilferty approximation of the
+// chi-square critical value below.
+const zScoreForChiSquarePValue = 3.090232306
+
+// minExpectedCount is the minimum expected count per subconn required for
+// the chi-square goodness-of-fit test to be valid.
+const minExpectedCount = 5
+
+// DistributionError is returned by IsWeightedRoundRobin when the observed
+// distribution of picks does not match the wanted distribution within
+// chiSquarePValue. It exposes the underlying numbers so failures can be
+// diagnosed without re-running the test under a debugger.
+type DistributionError struct {
+	Got       map[balancer.SubConn]int
+	Want      map[balancer.SubConn]float64
+	ChiSquare float64
+	Threshold float64
+}
+
+func (e *DistributionError) Error() string {
+	return fmt.Sprintf("distribution of picks %v does not match wanted weights %v: chi-square statistic %v exceeds critical value %v at p-value %v", e.Got, e.Want, e.ChiSquare, e.Threshold, chiSquarePValue)
+}
+
+// IsWeightedRoundRobin checks whether the SubConns returned by f are
+// distributed according to the weights in want. It collects iterations
+// picks from f, tallies the counts per SubConn, and applies a chi-square
+// goodness-of-fit test against the expected distribution derived from want.
+//
+// Unlike IsRoundRobin, this does not require an exact repeating permutation,
+// which makes it suitable for pickers that pick randomly (e.g. weighted
+// random, or EDF-scheduled weighted round robin) rather than deterministically
+// cycling through SubConns.
+//
+// iterations must be large enough that every want entry has an expected
+// count of at least 5 (the classical validity condition for a chi-square
+// test); otherwise an error is returned describing which entry is too small.
+func IsWeightedRoundRobin(want map[balancer.SubConn]float64, iterations int, f func() balancer.SubConn) error {
+	var totalWeight float64
+	for _, w := range want {
+		totalWeight += w
+	}
+	if totalWeight <= 0 {
+		return fmt.Errorf("sum of weights in want (%v) must be positive", want)
+	}
+
+	got := make(map[balancer.SubConn]int, len(want))
+	for i := 0; i < iterations; i++ {
+		got[f()]++
+	}
+	for sc := range got {
+		if _, ok := want[sc]; !ok {
+			return fmt.Errorf("got unexpected SubConn %v, not present in want %v", sc, want)
+		}
+	}
+
+	var chiSquare float64
+	for sc, w := range want {
+		expected := float64(iterations) * w / totalWeight
+		if expected < minExpectedCount {
+			return fmt.Errorf("expected count %v for %v is below the minimum of %v required for a valid chi-square test; increase iterations", expected, sc, minExpectedCount)
+		}
+		observed := float64(got[sc])
+		diff := observed - expected
+		chiSquare += diff * diff / expected
+	}
+
+	if len(want) < 2 {
+		// A chi-square test needs at least one degree of freedom; with a
+		// single wanted SubConn, and no unexpected ones (checked above), the
+		// distribution trivially matches.
+		return nil
+	}
+
+	threshold := chiSquareCriticalValue(len(want) - 1)
+	if chiSquare > threshold {
+		return &DistributionError{Got: got, Want: want, ChiSquare: chiSquare, Threshold: threshold}
+	}
+	return nil
+}
+
+// chiSquareCriticalValue approximates the chi-square critical value for df
+// degrees of freedom at the chiSquarePValue significance level, using the
+// Wilson-Hilferty cube-root approximation.
+func chiSquareCriticalValue(df int) float64 {
+	d := float64(df)
+	t := 2 / (9 * d)
+	return d * math.Pow(1-t+zScoreForChiSquarePValue*math.Sqrt(t), 3)
+}